@@ -1,8 +1,18 @@
 package errors
 
 import (
+	"context"
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestErrors(t *testing.T) {
@@ -44,4 +54,1095 @@ func TestErrors(t *testing.T) {
 			t.Fatalf("Expected %s got %s", e.Status, pe.Status)
 		}
 	}
-}
\ No newline at end of file
+}
+
+func TestBinary(t *testing.T) {
+	e := &Error{
+		Id:         "test",
+		Code:       404,
+		Detail:     "Not found",
+		Status:     http.StatusText(404),
+		RetryAfter: 1500 * time.Millisecond,
+		Stack:      "main.main",
+	}
+
+	b, err := e.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+
+	be := new(Error)
+	if err := be.UnmarshalBinary(b); err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+
+	if be.Error() != e.Error() {
+		t.Fatalf("Expected %s got %s", e.Error(), be.Error())
+	}
+
+	if be.RetryAfter != e.RetryAfter {
+		t.Fatalf("Expected %v got %v", e.RetryAfter, be.RetryAfter)
+	}
+
+	if be.Stack != e.Stack {
+		t.Fatalf("Expected %s got %s", e.Stack, be.Stack)
+	}
+}
+
+func TestContext(t *testing.T) {
+	ne := NotFound("test", "Not found")
+	ctx := WithError(context.Background(), ne)
+
+	e, ok := ErrorFromContext(ctx)
+	if !ok {
+		t.Fatalf("Expected error in context got none")
+	}
+
+	if e != ne {
+		t.Fatalf("Expected %s got %s", ne.Error(), e.Error())
+	}
+
+	if e, ok := ErrorFromContext(context.Background()); ok {
+		t.Fatalf("Expected no error got %v", e)
+	}
+}
+
+func TestDefaultID(t *testing.T) {
+	e := BadRequest("", "bad request").(*Error)
+	if e.Id != "" {
+		t.Fatalf("Expected empty id got %s", e.Id)
+	}
+
+	SetDefaultIDForCode(400, "bad_request")
+	defer SetDefaultIDForCode(400, "")
+
+	e = BadRequest("", "bad request").(*Error)
+	if e.Id != "bad_request" {
+		t.Fatalf("Expected %s got %s", "bad_request", e.Id)
+	}
+
+	e = BadRequest("test", "bad request").(*Error)
+	if e.Id != "test" {
+		t.Fatalf("Expected %s got %s", "test", e.Id)
+	}
+}
+
+func TestPublic(t *testing.T) {
+	e := InternalServerError("test", "db password is wrong").(*Error)
+	pe := e.Public()
+
+	if pe.Detail != http.StatusText(500) {
+		t.Fatalf("Expected %s got %s", http.StatusText(500), pe.Detail)
+	}
+
+	if e.Detail != "db password is wrong" {
+		t.Fatalf("Expected original detail to be kept got %s", e.Detail)
+	}
+
+	e = BadRequest("test", "name is required").(*Error)
+	if pe := e.Public(); pe.Detail != e.Detail {
+		t.Fatalf("Expected %s got %s", e.Detail, pe.Detail)
+	}
+
+	e = Here(BadRequest("test", "name is required")).(*Error).
+		WithMetadata("response_body", "upstream body")
+	if pe := e.Public(); pe.Metadata != nil || strings.Contains(pe.Error(), "metadata") {
+		t.Fatalf("Expected metadata to be removed got %s", pe.Error())
+	}
+
+	SetPublicDetail(400, false)
+	defer SetPublicDetail(400, true)
+
+	if pe := e.Public(); pe.Detail != http.StatusText(400) {
+		t.Fatalf("Expected %s got %s", http.StatusText(400), pe.Detail)
+	}
+}
+
+func TestAnnotate(t *testing.T) {
+	e := NotFound("test", "user not found")
+	ae := Annotate(e, "loading profile %d", 1).(*Error)
+
+	if ae.Code != 404 || ae.Id != "test" || ae.Status != http.StatusText(404) {
+		t.Fatalf("Expected classification to be kept got %s", ae.Error())
+	}
+
+	if ae.Detail != "loading profile 1: user not found" {
+		t.Fatalf("Expected %s got %s", "loading profile 1: user not found", ae.Detail)
+	}
+
+	ae = Annotate(stderrors.New("connection refused"), "loading profile").(*Error)
+	if ae.Code != 500 {
+		t.Fatalf("Expected %d got %d", 500, ae.Code)
+	}
+
+	if ae.Detail != "loading profile: connection refused" {
+		t.Fatalf("Expected %s got %s", "loading profile: connection refused", ae.Detail)
+	}
+
+	if ae := Annotate(context.Canceled, "loading profile"); !stderrors.Is(ae, context.Canceled) {
+		t.Fatalf("Expected annotated error to wrap %v", context.Canceled)
+	}
+
+	ae = Annotate(fmt.Errorf("wrap: %w", e), "loading profile").(*Error)
+	if ae.Code != 404 || ae.Id != "test" || ae.Detail != "loading profile: user not found" {
+		t.Fatalf("Expected wrapped classification to be kept got %s", ae.Error())
+	}
+}
+
+func TestStrictFormatting(t *testing.T) {
+	StrictFormatting = true
+	defer func() { StrictFormatting = false }()
+
+	e := BadRequest("test", "%d%% of %s is %*d", 50, "quota", 3, 7).(*Error)
+	if e.Detail != "50% of quota is   7" {
+		t.Fatalf("Expected %s got %s", "50% of quota is   7", e.Detail)
+	}
+
+	e = BadRequest("test", "%[1]s %[1]s", "v").(*Error)
+	if e.Detail != "v v" {
+		t.Fatalf("Expected %s got %s", "v v", e.Detail)
+	}
+
+	e = BadRequest("test", "%[1]s is %[1]s, %[3]d%[2]s", "ok", "%", 5).(*Error)
+	if e.Detail != "ok is ok, 5%" {
+		t.Fatalf("Expected %s got %s", "ok is ok, 5%", e.Detail)
+	}
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Fatalf("Expected panic for mismatched format got none")
+		}
+	}()
+	format, args := "id %d is invalid", []interface{}{}
+	BadRequest("test", format, args...)
+}
+
+func TestOnError(t *testing.T) {
+	var ids []string
+	unregisterFirst := OnError(func(e *Error) {
+		if e.Id == "hook:test" {
+			ids = append(ids, "first")
+		}
+	})
+	defer unregisterFirst()
+	unregisterSecond := OnError(func(e *Error) {
+		if e.Id == "hook:test" {
+			ids = append(ids, "second")
+		}
+	})
+	defer unregisterSecond()
+
+	Conflict("hook:test", "already exists")
+
+	if len(ids) != 2 || ids[0] != "first" || ids[1] != "second" {
+		t.Fatalf("Expected hooks to fire in order got %v", ids)
+	}
+
+	unregisterFirst()
+	Conflict("hook:test", "already exists")
+
+	if len(ids) != 3 || ids[2] != "second" {
+		t.Fatalf("Expected only the second hook to fire got %v", ids)
+	}
+}
+
+func TestFieldErrors(t *testing.T) {
+	e := UnprocessableEntity("test", "validation failed").(*Error)
+	if e.Code != 422 || e.Status != http.StatusText(422) {
+		t.Fatalf("Expected 422 got %s", e.Error())
+	}
+
+	if e.Error() != `{"id":"test","code":422,"detail":"validation failed","status":"Unprocessable Entity"}` {
+		t.Fatalf("Expected field errors to be omitted got %s", e.Error())
+	}
+
+	e.AddFieldError("name", "is required").AddFieldError("age", "must be positive")
+
+	pe := Parse(e.Error())
+	if len(pe.FieldErrors) != 2 {
+		t.Fatalf("Expected 2 field errors got %v", pe.FieldErrors)
+	}
+
+	if pe.FieldErrors["name"] != "is required" {
+		t.Fatalf("Expected %s got %s", "is required", pe.FieldErrors["name"])
+	}
+
+	if pe.FieldErrors["age"] != "must be positive" {
+		t.Fatalf("Expected %s got %s", "must be positive", pe.FieldErrors["age"])
+	}
+}
+
+func TestDetailEquals(t *testing.T) {
+	if !DetailEquals(NotFound("test", "user not found"), "user not found") {
+		t.Fatalf("Expected detail to match")
+	}
+
+	if DetailEquals(NotFound("test", "user not found"), "not found") {
+		t.Fatalf("Expected detail not to match")
+	}
+
+	if !DetailEquals(stderrors.New("user not found"), "user not found") {
+		t.Fatalf("Expected message to match")
+	}
+
+	if DetailEquals(nil, "") {
+		t.Fatalf("Expected nil error not to match")
+	}
+}
+
+func TestParseMany(t *testing.T) {
+	es, err := ParseMany(NotFound("test", "not found").Error())
+	if err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+
+	if len(es) != 1 || es[0].Code != 404 {
+		t.Fatalf("Expected one 404 error got %v", es)
+	}
+
+	body := "[" + BadRequest("a", "bad").Error() + "," + Conflict("b", "conflict").Error() + "]"
+	es, err = ParseMany(body)
+	if err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+
+	if len(es) != 2 || es[0].Id != "a" || es[1].Code != 409 {
+		t.Fatalf("Expected two errors got %v", es)
+	}
+
+	for _, body := range []string{"not json", "[null]", "[" + BadRequest("a", "bad").Error() + ",null]"} {
+		if _, err := ParseMany(body); err == nil {
+			t.Fatalf("Expected error for %s got nil", body)
+		}
+	}
+}
+
+func TestValidationError(t *testing.T) {
+	e := ValidationError("test", map[string]string{
+		"name": "is required",
+		"age":  "must be positive",
+	}).(*Error)
+
+	if e.Code != 400 {
+		t.Fatalf("Expected %d got %d", 400, e.Code)
+	}
+
+	if e.Detail != "validation failed for 2 fields" {
+		t.Fatalf("Expected %s got %s", "validation failed for 2 fields", e.Detail)
+	}
+
+	if len(e.FieldErrors) != 2 || e.FieldErrors["name"] != "is required" {
+		t.Fatalf("Expected field errors to be set got %v", e.FieldErrors)
+	}
+}
+
+func TestNewf(t *testing.T) {
+	SetDefaultIDForCode(429, "rate_limited")
+	defer SetDefaultIDForCode(429, "")
+
+	e := Newf(429, "retry in %d seconds", 30).(*Error)
+	if e.Id != "rate_limited" || e.Detail != "retry in 30 seconds" {
+		t.Fatalf("Expected registered id got %s", e.Error())
+	}
+
+	e = Newf(418, "short and stout").(*Error)
+	if e.Id != "" {
+		t.Fatalf("Expected empty id got %s", e.Id)
+	}
+
+	if e.Status != http.StatusText(418) {
+		t.Fatalf("Expected %s got %s", http.StatusText(418), e.Status)
+	}
+}
+
+func TestAs(t *testing.T) {
+	ne := NotFound("test", "not found")
+
+	if e, ok := As(ne); !ok || e != ne {
+		t.Fatalf("Expected %v got %v", ne, e)
+	}
+
+	if e, ok := As(fmt.Errorf("loading user: %w", ne)); !ok || e != ne {
+		t.Fatalf("Expected %v got %v", ne, e)
+	}
+
+	if e, ok := As(stderrors.New("not found")); ok {
+		t.Fatalf("Expected no error got %v", e)
+	}
+}
+
+func TestCategory(t *testing.T) {
+	SetCategoryForPrefix("auth", "auth")
+	defer SetCategoryForPrefix("auth", "")
+
+	e := Unauthorized("auth:tokenExpired", "token expired").(*Error)
+	if e.Category != "auth" {
+		t.Fatalf("Expected %s got %s", "auth", e.Category)
+	}
+
+	e = Unauthorized("billing:cardDeclined", "card declined").(*Error)
+	if e.Category != "" {
+		t.Fatalf("Expected empty category got %s", e.Category)
+	}
+}
+
+func TestMinimalJSON(t *testing.T) {
+	e := NotFound("test", "not found").(*Error)
+
+	var m map[string]interface{}
+	if err := json.Unmarshal(e.MinimalJSON(), &m); err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+
+	if len(m) != 2 || m["code"] != float64(404) || m["detail"] != "not found" {
+		t.Fatalf("Expected code and detail only got %v", m)
+	}
+}
+
+func TestJoin(t *testing.T) {
+	e1 := NotFound("test", "user not found")
+	e2 := stderrors.New("cache unavailable")
+
+	je := Join(e1, nil, e2).(*Error)
+	if je.Code != 500 {
+		t.Fatalf("Expected %d got %d", 500, je.Code)
+	}
+
+	if je.Detail != "user not found; cache unavailable" {
+		t.Fatalf("Expected %s got %s", "user not found; cache unavailable", je.Detail)
+	}
+
+	if !stderrors.Is(je, e1) || !stderrors.Is(je, e2) {
+		t.Fatalf("Expected joined error to match both causes")
+	}
+
+	if !je.Is(e1) || !je.Is(e2) {
+		t.Fatalf("Expected joined error to match both causes")
+	}
+
+	var pe *os.PathError
+	if !stderrors.As(Join(e1, &os.PathError{Op: "open", Path: "a", Err: os.ErrNotExist}), &pe) || pe.Op != "open" {
+		t.Fatalf("Expected to find the path error got %v", pe)
+	}
+
+	if err := Join(nil, nil); err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+}
+
+func TestFromRecover(t *testing.T) {
+	recovered := func(v interface{}) (e *Error) {
+		defer func() { e = FromRecover(recover()) }()
+		panic(v)
+	}
+
+	if e := recovered("boom"); e.Code != 500 || e.Detail != "boom" {
+		t.Fatalf("Expected 500 boom got %s", e.Error())
+	}
+
+	if e := recovered(stderrors.New("boom")); e.Code != 500 || e.Detail != "boom" {
+		t.Fatalf("Expected 500 boom got %s", e.Error())
+	}
+
+	ne := Forbidden("test", "forbidden")
+	if e := recovered(ne); e != ne {
+		t.Fatalf("Expected %s got %s", ne.Error(), e.Error())
+	}
+
+	if e := FromRecover(nil); e != nil {
+		t.Fatalf("Expected nil got %v", e)
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	e1 := NotFound("test", "user 1 not found").(*Error)
+	e2 := NotFound("test", "user 2 not found").(*Error)
+
+	if e1.Fingerprint() != e2.Fingerprint() {
+		t.Fatalf("Expected %s got %s", e1.Fingerprint(), e2.Fingerprint())
+	}
+
+	if e3 := Gone("test", "user 1 not found").(*Error); e3.Fingerprint() == e1.Fingerprint() {
+		t.Fatalf("Expected different fingerprints for different codes")
+	}
+}
+
+func TestHTTPStatusCode(t *testing.T) {
+	testData := map[int32]int{
+		0:   500,
+		200: 200,
+		404: 404,
+		600: 500,
+	}
+
+	for code, status := range testData {
+		e := &Error{Code: code}
+		if got := e.HTTPStatusCode(); got != status {
+			t.Fatalf("Expected %d got %d", status, got)
+		}
+	}
+}
+
+func TestIDParts(t *testing.T) {
+	e := &Error{Id: "billing:invoiceMissing"}
+	if ns, name, version := e.IDParts(); ns != "billing" || name != "invoiceMissing" || version != "" {
+		t.Fatalf("Expected billing invoiceMissing got %s %s %s", ns, name, version)
+	}
+
+	e = &Error{Id: "billing:invoiceMissing:v2"}
+	if ns, name, version := e.IDParts(); ns != "billing" || name != "invoiceMissing" || version != "v2" {
+		t.Fatalf("Expected billing invoiceMissing v2 got %s %s %s", ns, name, version)
+	}
+}
+
+func TestCodeAsString(t *testing.T) {
+	e := NotFound("test", "not found").(*Error)
+
+	if e.Error() != `{"id":"test","code":404,"detail":"not found","status":"Not Found"}` {
+		t.Fatalf("Expected numeric code got %s", e.Error())
+	}
+
+	CodeAsString = true
+	defer func() { CodeAsString = false }()
+
+	var m map[string]interface{}
+	if err := json.Unmarshal([]byte(e.Error()), &m); err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+
+	if m["code"] != "404" {
+		t.Fatalf("Expected %q got %v", "404", m["code"])
+	}
+
+	if pe := Parse(e.Error()); pe.Code != 404 || pe.Detail != "not found" {
+		t.Fatalf("Expected 404 not found got %s", pe.Error())
+	}
+}
+
+func TestToURLValues(t *testing.T) {
+	e := NotFound("test", "user not found").(*Error)
+
+	expected := "code=404&detail=user+not+found&id=test&status=Not+Found"
+	if got := e.ToURLValues().Encode(); got != expected {
+		t.Fatalf("Expected %s got %s", expected, got)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	calls := 0
+	err := Retry(3, time.Millisecond, func() error {
+		calls++
+		if calls < 3 {
+			return InternalServerError("test", "attempt %d failed", calls)
+		}
+		return nil
+	})
+
+	if err != nil || calls != 3 {
+		t.Fatalf("Expected success after 3 calls got %v after %d", err, calls)
+	}
+
+	calls = 0
+	err = Retry(2, time.Millisecond, func() error {
+		calls++
+		return InternalServerError("test", "attempt %d failed", calls)
+	})
+
+	if e, ok := err.(*Error); !ok || e.Detail != "attempt 2 failed" {
+		t.Fatalf("Expected last error got %v", err)
+	}
+
+	if e := err.(*Error); e.Metadata["attempts"] != "2" {
+		t.Fatalf("Expected %s got %s", "2", e.Metadata["attempts"])
+	}
+
+	calls = 0
+	err = Retry(0, time.Millisecond, func() error {
+		calls++
+		return InternalServerError("test", "failed")
+	})
+
+	if e, ok := err.(*Error); calls != 1 || !ok || e.Metadata["attempts"] != "1" {
+		t.Fatalf("Expected a single call got %d and %v", calls, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = RetryContext(ctx, 2, time.Hour, func() error {
+		return InternalServerError("test", "failed")
+	})
+
+	if e, ok := err.(*Error); !ok || e.Detail != "failed" || e.Metadata["attempts"] != "1" {
+		t.Fatalf("Expected last error after 1 attempt got %v", err)
+	}
+}
+
+func TestSafe(t *testing.T) {
+	e := InternalServerError("test", "db password is wrong").(*Error).
+		WithDeveloperDetail("dsn postgres://admin@db")
+
+	var logged *Error
+	se := e.Safe(func(le *Error) {
+		logged = le
+	})
+
+	if logged.Detail != "db password is wrong" || logged.DeveloperDetail != "dsn postgres://admin@db" {
+		t.Fatalf("Expected full error to be logged got %s", logged.Error())
+	}
+
+	if se.Detail != http.StatusText(500) {
+		t.Fatalf("Expected %s got %s", http.StatusText(500), se.Detail)
+	}
+
+	if se.DeveloperDetail != "" {
+		t.Fatalf("Expected empty developer detail got %s", se.DeveloperDetail)
+	}
+
+	if e := BadRequest("test", "name is required").(*Error); e.Safe(nil).Detail != e.Detail {
+		t.Fatalf("Expected %s got %s", e.Detail, e.Safe(nil).Detail)
+	}
+
+	SetPublicDetail(400, false)
+	defer SetPublicDetail(400, true)
+
+	if se := BadRequest("test", "name is required").(*Error).Safe(nil); se.Detail != http.StatusText(400) {
+		t.Fatalf("Expected %s got %s", http.StatusText(400), se.Detail)
+	}
+}
+
+func TestSource(t *testing.T) {
+	e := NotFound("test", "not found").(*Error)
+	if e.Error() != `{"id":"test","code":404,"detail":"not found","status":"Not Found"}` {
+		t.Fatalf("Expected source to be omitted got %s", e.Error())
+	}
+
+	SetSource("billing")
+	defer SetSource("")
+
+	e = NotFound("test", "not found").(*Error)
+	if e.Source != "billing" {
+		t.Fatalf("Expected %s got %s", "billing", e.Source)
+	}
+}
+
+func TestResourceNotFound(t *testing.T) {
+	e := ResourceNotFound("user", "42").(*Error)
+
+	if e.Code != 404 || e.Id != "user:notFound" {
+		t.Fatalf("Expected 404 user:notFound got %s", e.Error())
+	}
+
+	if e.Detail != "user with id 42 not found" {
+		t.Fatalf("Expected %s got %s", "user with id 42 not found", e.Detail)
+	}
+}
+
+func TestFindByCode(t *testing.T) {
+	nf := NotFound("test", "user not found")
+	je := Join(stderrors.New("cache unavailable"), fmt.Errorf("loading user: %w", nf))
+	err := fmt.Errorf("handler: %w", je)
+
+	if e := FindByCode(err, 500); e != je {
+		t.Fatalf("Expected %v got %v", je, e)
+	}
+
+	if e := FindByCode(err, 404); e != nf {
+		t.Fatalf("Expected %v got %v", nf, e)
+	}
+
+	if e := FindByCode(err, 409); e != nil {
+		t.Fatalf("Expected nil got %v", e)
+	}
+}
+
+func TestRegisterStatusText(t *testing.T) {
+	RegisterStatusText(460, "Custom Condition")
+
+	e := New("test", "custom", 460).(*Error)
+	if e.Status != "Custom Condition" {
+		t.Fatalf("Expected %s got %s", "Custom Condition", e.Status)
+	}
+
+	e = NotFound("test", "not found").(*Error)
+	if e.Status != http.StatusText(404) {
+		t.Fatalf("Expected %s got %s", http.StatusText(404), e.Status)
+	}
+}
+
+func TestFromContextErr(t *testing.T) {
+	if e := FromContextErr(context.DeadlineExceeded); e.Code != 408 || e.Status != http.StatusText(408) {
+		t.Fatalf("Expected 408 got %s", e.Error())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if e := FromContextErr(ctx.Err()); e.Code != 499 || e.Status != "Client Closed Request" {
+		t.Fatalf("Expected 499 got %s", e.Error())
+	}
+
+	if e := FromContextErr(nil); e != nil {
+		t.Fatalf("Expected nil got %v", e)
+	}
+}
+
+func TestLogLine(t *testing.T) {
+	e := &Error{
+		Id:     "test",
+		Code:   404,
+		Detail: "user john@example.com not found",
+		Status: http.StatusText(404),
+		Source: "billing",
+	}
+
+	expected := `id="test" code=404 status="Not Found" source="billing"`
+	if got := e.LogLine(); got != expected {
+		t.Fatalf("Expected %s got %s", expected, got)
+	}
+}
+
+func TestPath(t *testing.T) {
+	e := NotFound("test", "not found").(*Error).WithPath("/users/42")
+	if pe := Parse(e.Error()); pe.Path != "/users/42" {
+		t.Fatalf("Expected %s got %s", "/users/42", pe.Path)
+	}
+
+	e = NotFoundForPath("/users/42").(*Error)
+	if e.Code != 404 || e.Id != "path:notFound" || e.Path != "/users/42" {
+		t.Fatalf("Expected 404 for /users/42 got %s", e.Error())
+	}
+}
+
+func TestDeveloperDetail(t *testing.T) {
+	e := BadRequest("test", "name is required").(*Error).
+		WithDeveloperDetail("field %s failed rule %s", "name", "required")
+
+	if e.DeveloperDetail != "field name failed rule required" {
+		t.Fatalf("Expected %s got %s", "field name failed rule required", e.DeveloperDetail)
+	}
+
+	pe := e.Public()
+	if pe.DeveloperDetail != "" {
+		t.Fatalf("Expected empty developer detail got %s", pe.DeveloperDetail)
+	}
+
+	if pe.Detail != "name is required" {
+		t.Fatalf("Expected %s got %s", "name is required", pe.Detail)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	e := New("test", "slow down", 429).(*Error).WithRetryAfter(30 * time.Second)
+
+	var m map[string]interface{}
+	if err := json.Unmarshal([]byte(e.Error()), &m); err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+
+	if m["retry_after"] != float64(30) {
+		t.Fatalf("Expected %d got %v", 30, m["retry_after"])
+	}
+
+	if d, ok := RetryAfterOf(fmt.Errorf("calling api: %w", Parse(e.Error()))); !ok || d != 30*time.Second {
+		t.Fatalf("Expected %v got %v", 30*time.Second, d)
+	}
+
+	if _, ok := RetryAfterOf(NotFound("test", "not found")); ok {
+		t.Fatalf("Expected no retry delay")
+	}
+
+	e = New("test", "slow down", 429).(*Error).WithRetryAfter(time.Minute)
+	if err := json.Unmarshal([]byte(`{"detail":"slower"}`), e); err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+
+	if e.RetryAfter != time.Minute || e.Detail != "slower" {
+		t.Fatalf("Expected retry delay to be kept got %v", e.RetryAfter)
+	}
+}
+
+func TestCaptureStack(t *testing.T) {
+	if e := NotFound("test", "not found").(*Error); e.Stack != "" {
+		t.Fatalf("Expected empty stack got %s", e.Stack)
+	}
+
+	CaptureStack = true
+	defer func() { CaptureStack = false }()
+
+	e := NotFound("test", "not found").(*Error)
+	if !strings.HasPrefix(e.Stack, "github.com/onskycloud/errors.TestCaptureStack\n") {
+		t.Fatalf("Expected stack to start at the caller got %s", e.Stack)
+	}
+
+	for _, out := range []string{e.Error(), e.Public().Error(), e.Safe(nil).Error()} {
+		if strings.Contains(out, "stack") || strings.Contains(out, "TestCaptureStack") {
+			t.Fatalf("Expected stack not to be serialized got %s", out)
+		}
+	}
+
+	if e.Public().Stack != "" || e.Safe(nil).Stack != "" {
+		t.Fatalf("Expected Public and Safe to clear the stack")
+	}
+}
+
+func TestEffectiveDetail(t *testing.T) {
+	testData := []struct {
+		e        *Error
+		expected string
+	}{
+		{&Error{Code: 404, Detail: "user not found", Status: "Not Found"}, "user not found"},
+		{&Error{Code: 404, Status: "Not Found"}, "Not Found"},
+		{&Error{Code: 404}, http.StatusText(404)},
+		{&Error{Code: 999}, "error code 999"},
+	}
+
+	for _, d := range testData {
+		if got := d.e.EffectiveDetail(); got != d.expected {
+			t.Fatalf("Expected %s got %s", d.expected, got)
+		}
+	}
+}
+
+func TestSetFormatter(t *testing.T) {
+	SetFormatter(func(format string, a ...interface{}) string {
+		return strings.ToUpper(fmt.Sprintf(format, a...))
+	})
+	defer SetFormatter(nil)
+
+	e := BadRequest("test", "name %s is taken", "bob").(*Error)
+	if e.Detail != "NAME BOB IS TAKEN" {
+		t.Fatalf("Expected %s got %s", "NAME BOB IS TAKEN", e.Detail)
+	}
+
+	e = ResourceNotFound("<script>", "1").(*Error)
+	if e.Detail != "<SCRIPT> WITH ID 1 NOT FOUND" {
+		t.Fatalf("Expected %s got %s", "<SCRIPT> WITH ID 1 NOT FOUND", e.Detail)
+	}
+
+	testData := []*Error{
+		ValidationError("test", map[string]string{"name": "is required"}).(*Error),
+		NotFoundForPath("/users").(*Error),
+		Join(stderrors.New("a"), stderrors.New("b")).(*Error),
+		FromRecover("boom"),
+		FromContextErr(context.Canceled),
+		Here(stderrors.New("boom")).(*Error),
+	}
+
+	for _, e := range testData {
+		if e.Detail != strings.ToUpper(e.Detail) {
+			t.Fatalf("Expected formatted detail got %s", e.Detail)
+		}
+	}
+
+	e = Annotate(stderrors.New("x"), "a%sb", "<").(*Error)
+	if e.Detail != "A<B: X" {
+		t.Fatalf("Expected %s got %s", "A<B: X", e.Detail)
+	}
+}
+
+func TestFormatterAppliedOnce(t *testing.T) {
+	SetFormatter(func(format string, a ...interface{}) string {
+		return html.EscapeString(fmt.Sprintf(format, a...))
+	})
+	defer SetFormatter(nil)
+
+	e := Join(BadRequest("a", "x & y"), stderrors.New("<b>")).(*Error)
+	if e.Detail != "x &amp; y; &lt;b&gt;" {
+		t.Fatalf("Expected %s got %s", "x &amp; y; &lt;b&gt;", e.Detail)
+	}
+
+	e = Annotate(stderrors.New("<script>"), "a<b").(*Error)
+	if e.Detail != "a&lt;b: &lt;script&gt;" {
+		t.Fatalf("Expected %s got %s", "a&lt;b: &lt;script&gt;", e.Detail)
+	}
+}
+
+func TestStatusSymbol(t *testing.T) {
+	if e := NotFound("test", "not found").(*Error); strings.Contains(e.Error(), "status_symbol") {
+		t.Fatalf("Expected no status symbol got %s", e.Error())
+	}
+
+	StatusSymbol = true
+	defer func() { StatusSymbol = false }()
+
+	testData := map[int32]string{
+		404: "NOT_FOUND",
+		500: "INTERNAL_SERVER_ERROR",
+	}
+
+	for code, symbol := range testData {
+		var m map[string]interface{}
+		if err := json.Unmarshal([]byte(New("test", "", code).Error()), &m); err != nil {
+			t.Fatalf("Expected nil got %v", err)
+		}
+
+		if m["status_symbol"] != symbol {
+			t.Fatalf("Expected %s got %v", symbol, m["status_symbol"])
+		}
+	}
+}
+
+func TestValidateErrorJSON(t *testing.T) {
+	if err := ValidateErrorJSON([]byte(NotFound("test", "not found").Error())); err != nil {
+		t.Fatalf("Expected nil got %v", err)
+	}
+
+	testData := []string{
+		`not json`,
+		`{"id":"test","code":404,"status":"Not Found"}`,
+		`{"id":"test","code":"abc","detail":"","status":""}`,
+		`{"id":"test","code":0,"detail":"","status":""}`,
+	}
+
+	for _, body := range testData {
+		if err := ValidateErrorJSON([]byte(body)); err == nil {
+			t.Fatalf("Expected error for %s got nil", body)
+		}
+	}
+}
+
+func TestForView(t *testing.T) {
+	RegisterView("public", "id", "code", "detail", "status")
+
+	e := BadRequest("test", "name is required").(*Error).
+		WithDeveloperDetail("rule required failed").
+		WithMetadata("internal_trace", "db.go:42")
+	e.Stack = "main.main"
+
+	pe := e.ForView("public")
+	if pe.DeveloperDetail != "" || pe.Stack != "" || pe.Metadata != nil {
+		t.Fatalf("Expected internal fields to be stripped got %s", pe.Error())
+	}
+
+	if pe.Id != e.Id || pe.Code != e.Code || pe.Detail != e.Detail || pe.Status != e.Status {
+		t.Fatalf("Expected public fields to be kept got %s", pe.Error())
+	}
+
+	RegisterView("trace", "id", "metadata")
+	if te := e.ForView("trace"); te.Metadata["internal_trace"] != "db.go:42" {
+		t.Fatalf("Expected %s got %s", "db.go:42", te.Metadata["internal_trace"])
+	}
+
+	if ie := e.ForView("internal"); ie.Error() != e.Error() {
+		t.Fatalf("Expected %s got %s", e.Error(), ie.Error())
+	}
+}
+
+func TestCounters(t *testing.T) {
+	EnableCounters()
+	ResetCounts()
+
+	New("counted", "first", 500)
+	New("counted", "second", 500)
+
+	if n := Counts()["counted"]; n != 2 {
+		t.Fatalf("Expected %d got %d", 2, n)
+	}
+
+	ResetCounts()
+	if n := Counts()["counted"]; n != 0 {
+		t.Fatalf("Expected %d got %d", 0, n)
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	testData := map[int32]bool{
+		400: false,
+		404: false,
+		407: false,
+		408: true,
+		409: false,
+		429: true,
+		500: true,
+		501: false,
+		502: true,
+		503: true,
+		504: true,
+		505: false,
+	}
+
+	for code, transient := range testData {
+		if got := IsTransient(New("test", "", code)); got != transient {
+			t.Fatalf("Expected %v for %d got %v", transient, code, got)
+		}
+	}
+
+	if IsTransient(stderrors.New("timeout")) {
+		t.Fatalf("Expected plain error not to be transient")
+	}
+}
+
+func TestPublicCopy(t *testing.T) {
+	e := UnprocessableEntity("test", "validation failed").(*Error).
+		AddFieldError("name", "is required")
+
+	for _, c := range []*Error{e.Public(), e.Safe(nil), e.ForView("unknown"), Annotate(e, "saving").(*Error)} {
+		c.AddFieldError("age", "must be positive")
+	}
+
+	if len(e.FieldErrors) != 1 {
+		t.Fatalf("Expected original field errors to be unchanged got %v", e.FieldErrors)
+	}
+
+	e = New("test", "custom failure", 560).(*Error)
+	if pe := e.Public(); pe.Detail != "error code 560" {
+		t.Fatalf("Expected %s got %s", "error code 560", pe.Detail)
+	}
+}
+
+func TestRedirect(t *testing.T) {
+	e := Redirect(308, "https://example.com/new").(*Error)
+	if e.Code != 308 || e.Status != http.StatusText(308) {
+		t.Fatalf("Expected 308 got %s", e.Error())
+	}
+
+	if pe := Parse(e.Error()); pe.Metadata["location"] != "https://example.com/new" {
+		t.Fatalf("Expected %s got %s", "https://example.com/new", pe.Metadata["location"])
+	}
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Fatalf("Expected panic for non 3xx code got none")
+		}
+	}()
+	Redirect(404, "https://example.com/new")
+}
+
+func TestFilterMetadata(t *testing.T) {
+	e := NotFound("test", "not found").(*Error).
+		WithMetadata("request_id", "abc").
+		WithMetadata("internal_trace", "db.go:42")
+
+	fe := e.FilterMetadata("request_id")
+	if len(fe.Metadata) != 1 || fe.Metadata["request_id"] != "abc" {
+		t.Fatalf("Expected only request_id got %v", fe.Metadata)
+	}
+
+	if len(e.Metadata) != 2 {
+		t.Fatalf("Expected original metadata to be kept got %v", e.Metadata)
+	}
+}
+
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestFromFailedResponse(t *testing.T) {
+	body := &closeRecorder{Reader: strings.NewReader(strings.Repeat("x", 100))}
+	resp := &http.Response{
+		Status:     "502 Bad Gateway",
+		StatusCode: 502,
+		Body:       body,
+	}
+
+	e := FromFailedResponse(resp, 10)
+	if e.Code != 502 || e.Detail != "unexpected response 502 Bad Gateway" {
+		t.Fatalf("Expected 502 got %s", e.Error())
+	}
+
+	if e.Metadata["response_body"] != strings.Repeat("x", 10) {
+		t.Fatalf("Expected truncated body got %s", e.Metadata["response_body"])
+	}
+
+	if !body.closed {
+		t.Fatalf("Expected body to be closed")
+	}
+}
+
+func TestInheritMetadata(t *testing.T) {
+	e := NotFound("test", "not found").(*Error).WithMetadata("trace_id", "abc")
+
+	if ae := Annotate(e, "loading user").(*Error); ae.Metadata["trace_id"] != "abc" {
+		t.Fatalf("Expected %s got %s", "abc", ae.Metadata["trace_id"])
+	}
+
+	if je := Join(e, stderrors.New("cache unavailable")).(*Error); je.Metadata["trace_id"] != "abc" {
+		t.Fatalf("Expected %s got %s", "abc", je.Metadata["trace_id"])
+	}
+
+	ne := InternalServerError("test", "failed").(*Error).
+		WithMetadata("trace_id", "def").
+		InheritMetadata(e.WithMetadata("user_id", "42"))
+
+	if ne.Metadata["trace_id"] != "def" || ne.Metadata["user_id"] != "42" {
+		t.Fatalf("Expected own keys to win and new keys to be copied got %v", ne.Metadata)
+	}
+}
+
+func TestHere(t *testing.T) {
+	e := Here(NotFound("test", "not found")).(*Error)
+	if !strings.Contains(e.Metadata["origin"], "errors_test.go:") {
+		t.Fatalf("Expected origin in errors_test.go got %s", e.Metadata["origin"])
+	}
+
+	e = Here(stderrors.New("connection refused")).(*Error)
+	if e.Code != 500 || !strings.Contains(e.Metadata["origin"], "errors_test.go:") {
+		t.Fatalf("Expected 500 with origin got %s", e.Error())
+	}
+
+	if err := Here(context.Canceled); !stderrors.Is(err, context.Canceled) {
+		t.Fatalf("Expected error to wrap %v", context.Canceled)
+	}
+
+	e = Here(fmt.Errorf("wrap: %w", NotFound("test", "not found"))).(*Error)
+	if e.Code != 404 || e.Id != "test" || e.Metadata["origin"] == "" {
+		t.Fatalf("Expected 404 with origin got %s", e.Error())
+	}
+}
+
+func TestStableJSON(t *testing.T) {
+	e := UnprocessableEntity("test", "validation failed").(*Error)
+	for _, key := range []string{"d", "a", "c", "b"} {
+		e.AddFieldError(key, "invalid "+key).WithMetadata(key, "value "+key)
+	}
+
+	expected := `{"id":"test","code":422,"detail":"validation failed","status":"Unprocessable Entity",` +
+		`"metadata":{"a":"value a","b":"value b","c":"value c","d":"value d"},` +
+		`"field_errors":{"a":"invalid a","b":"invalid b","c":"invalid c","d":"invalid d"}}`
+
+	for i := 0; i < 20; i++ {
+		if got := e.Error(); got != expected {
+			t.Fatalf("Expected %s got %s", expected, got)
+		}
+	}
+}
+
+func TestFromHTTPResponseFull(t *testing.T) {
+	header := http.Header{}
+	header.Set("Retry-After", "120")
+	header.Set("X-Request-ID", "abc")
+	resp := &http.Response{
+		StatusCode: 429,
+		Header:     header,
+		Body:       ioutil.NopCloser(strings.NewReader(`{"id":"rate","detail":"slow down"}`)),
+	}
+
+	e := FromHTTPResponseFull(resp, "X-Request-ID")
+	if e.Code != 429 || e.Status != http.StatusText(429) || e.Id != "rate" || e.Detail != "slow down" {
+		t.Fatalf("Expected 429 rate slow down got %s", e.Error())
+	}
+
+	if e.RetryAfter != 120*time.Second {
+		t.Fatalf("Expected %v got %v", 120*time.Second, e.RetryAfter)
+	}
+
+	if e.Metadata["X-Request-ID"] != "abc" {
+		t.Fatalf("Expected %s got %s", "abc", e.Metadata["X-Request-ID"])
+	}
+
+	resp = &http.Response{
+		StatusCode: 400,
+		Header:     header,
+		Body:       ioutil.NopCloser(strings.NewReader("bad input")),
+	}
+
+	e = FromHTTPResponseFull(resp)
+	if e.Code != 400 || e.Detail != "bad input" || e.RetryAfter != 0 || e.Metadata != nil {
+		t.Fatalf("Expected 400 bad input without retry delay got %s", e.Error())
+	}
+}
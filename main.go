@@ -3,35 +3,692 @@
 package errors
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	stderrors "errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"net/url"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 // RedisEmpty redis empty value response
 const RedisEmpty = "redis: nil"
 
+// StrictFormatting makes the constructors panic when the number of
+// verbs in a format string does not match the number of arguments.
+// It is meant to be enabled in tests.
+var StrictFormatting = false
+
+// CaptureStack makes the constructors record the stack of the caller
+// in Stack. It is meant for development as it is costly. The stack is
+// never sent over the wire.
+var CaptureStack = false
+
+// StackSkip is the number of extra frames to skip when capturing the
+// stack, for callers that wrap the constructors.
+var StackSkip = 0
+
+// CodeAsString makes errors encode their code as a JSON string, e.g.
+// "404" instead of 404.
+var CodeAsString = false
+
+// StatusSymbol makes errors include a symbolic status such as
+// "NOT_FOUND" in their JSON encoding.
+var StatusSymbol = false
+
+// errorKey is the context key under which WithError stores an error.
+type errorKey struct{}
+
 // Error implements the error interface.
 type Error struct {
 	Id     string `json:"id"`
 	Code   int32  `json:"code"`
 	Detail string `json:"detail"`
 	Status string `json:"status"`
+	// DeveloperDetail is a detail meant for developers rather than users.
+	DeveloperDetail string `json:"developer_detail,omitempty"`
+	// Category is a coarse grouping derived from the id prefix.
+	Category string `json:"category,omitempty"`
+	// Source is the name of the service that created the error.
+	Source string `json:"source,omitempty"`
+	// Path is the request path that failed.
+	Path string `json:"path,omitempty"`
+	// Metadata holds additional context about the error.
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// FieldErrors holds per-field validation messages.
+	FieldErrors map[string]string `json:"field_errors,omitempty"`
+	// RetryAfter is how long the client should wait before retrying. It
+	// is encoded in whole seconds.
+	RetryAfter time.Duration `json:"retry_after,omitempty"`
+	// Stack is the stack of the caller, set only when CaptureStack is on.
+	// It is never included in the JSON encoding.
+	Stack string `json:"-"`
+
+	causes []error
 }
 
 func (e *Error) Error() string {
-	b, _ := json.Marshal(e)
+	b, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Sprintf("id=%s code=%d detail=%s status=%s", e.Id, e.Code, e.Detail, e.Status)
+	}
 	return string(b)
 }
 
-// New generates a custom error.
-func New(id, detail string, code int32) error {
-	return &Error{
+// clone returns a copy of the error that shares no maps with e.
+func (e *Error) clone() *Error {
+	c := *e
+	if e.FieldErrors != nil {
+		c.FieldErrors = make(map[string]string, len(e.FieldErrors))
+		for field, msg := range e.FieldErrors {
+			c.FieldErrors[field] = msg
+		}
+	}
+	if e.Metadata != nil {
+		c.Metadata = make(map[string]string, len(e.Metadata))
+		for key, value := range e.Metadata {
+			c.Metadata[key] = value
+		}
+	}
+	return &c
+}
+
+// MarshalJSON implements json.Marshaler, encoding the code as a string
+// when CodeAsString is set, the retry delay in seconds and the status
+// symbol when StatusSymbol is set.
+func (e *Error) MarshalJSON() ([]byte, error) {
+	type alias Error
+	retryAfter := int64((e.RetryAfter + time.Second - 1) / time.Second)
+	var symbol string
+	if StatusSymbol {
+		symbol = statusSymbol(e.Code)
+	}
+	if !CodeAsString {
+		return json.Marshal(struct {
+			*alias
+			RetryAfter   int64  `json:"retry_after,omitempty"`
+			StatusSymbol string `json:"status_symbol,omitempty"`
+		}{(*alias)(e), retryAfter, symbol})
+	}
+	return json.Marshal(struct {
+		*alias
+		Code         int32  `json:"code,string"`
+		RetryAfter   int64  `json:"retry_after,omitempty"`
+		StatusSymbol string `json:"status_symbol,omitempty"`
+	}{(*alias)(e), e.Code, retryAfter, symbol})
+}
+
+// statusSymbol returns the status text of code as an upper case
+// symbol, e.g. NOT_FOUND for 404.
+func statusSymbol(code int32) string {
+	var b strings.Builder
+	for _, r := range strings.ToUpper(statusText(code)) {
+		switch {
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			b.WriteRune(r)
+		case r == ' ' || r == '-':
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
+
+// UnmarshalJSON implements json.Unmarshaler. The code may be either a
+// number or a string.
+func (e *Error) UnmarshalJSON(data []byte) error {
+	type alias Error
+	v := struct {
+		*alias
+		Code       json.Number `json:"code"`
+		RetryAfter *int64      `json:"retry_after"`
+	}{alias: (*alias)(e)}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	if v.RetryAfter != nil {
+		e.RetryAfter = time.Duration(*v.RetryAfter) * time.Second
+	}
+	if v.Code != "" {
+		code, err := strconv.ParseInt(string(v.Code), 10, 32)
+		if err != nil {
+			return err
+		}
+		e.Code = int32(code)
+	}
+	return nil
+}
+
+// Unwrap returns the errors wrapped by Join, Annotate or Here.
+func (e *Error) Unwrap() []error {
+	return e.causes
+}
+
+// Is reports whether any of the wrapped errors matches target. It lets
+// errors.Is look through them before Go 1.20, which does not follow
+// Unwrap() []error.
+func (e *Error) Is(target error) bool {
+	for _, cause := range e.causes {
+		if stderrors.Is(cause, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first of the wrapped errors that matches target, for
+// errors.As before Go 1.20.
+func (e *Error) As(target interface{}) bool {
+	for _, cause := range e.causes {
+		if stderrors.As(cause, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// MinimalJSON returns the JSON encoding of only the code and detail.
+func (e *Error) MinimalJSON() []byte {
+	b, _ := json.Marshal(struct {
+		Code   int32  `json:"code"`
+		Detail string `json:"detail"`
+	}{e.Code, e.Detail})
+	return b
+}
+
+// ToURLValues returns the error as form values.
+func (e *Error) ToURLValues() url.Values {
+	return url.Values{
+		"id":     {e.Id},
+		"code":   {strconv.Itoa(int(e.Code))},
+		"detail": {e.Detail},
+		"status": {e.Status},
+	}
+}
+
+// EffectiveDetail returns the detail if it is set, otherwise the status
+// text, otherwise a message built from the code.
+func (e *Error) EffectiveDetail() string {
+	switch {
+	case e.Detail != "":
+		return e.Detail
+	case e.Status != "":
+		return e.Status
+	case statusText(e.Code) != "":
+		return statusText(e.Code)
+	default:
+		return fmt.Sprintf("error code %d", e.Code)
+	}
+}
+
+// LogLine returns a single key=value line with the id, code, status and
+// source. The detail is left out as it may contain personal data.
+func (e *Error) LogLine() string {
+	return fmt.Sprintf("id=%q code=%d status=%q source=%q", e.Id, e.Code, e.Status, e.Source)
+}
+
+// HTTPStatusCode returns the code if it is a valid HTTP status and 500
+// otherwise.
+func (e *Error) HTTPStatusCode() int {
+	if e.Code < 100 || e.Code > 599 {
+		return http.StatusInternalServerError
+	}
+	return int(e.Code)
+}
+
+// IDParts splits an id of the form "namespace:name:version" into its
+// parts. Missing parts are returned as empty strings.
+func (e *Error) IDParts() (namespace, name, version string) {
+	parts := strings.SplitN(e.Id, ":", 3)
+	parts = append(parts, "", "")
+	return parts[0], parts[1], parts[2]
+}
+
+// IsTransient reports whether the error is likely to go away on retry,
+// which is the case for 408, 429, 500, 502, 503 and 504.
+func (e *Error) IsTransient() bool {
+	switch e.Code {
+	case 408, 429, 500, 502, 503, 504:
+		return true
+	}
+	return false
+}
+
+// Fingerprint returns a SHA-256 hex hash of the id and code. The detail
+// is left out on purpose so that errors of the same class group
+// together regardless of their message.
+func (e *Error) Fingerprint() string {
+	h := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%d", e.Id, e.Code)))
+	return hex.EncodeToString(h[:])
+}
+
+// WithDeveloperDetail sets the developer detail and returns the error so
+// calls can be chained.
+func (e *Error) WithDeveloperDetail(format string, a ...interface{}) *Error {
+	e.DeveloperDetail = sprintf(format, a...)
+	return e
+}
+
+// WithRetryAfter sets the retry delay and returns the error so calls
+// can be chained.
+func (e *Error) WithRetryAfter(d time.Duration) *Error {
+	e.RetryAfter = d
+	return e
+}
+
+// WithPath sets the request path and returns the error so calls can be
+// chained.
+func (e *Error) WithPath(p string) *Error {
+	e.Path = p
+	return e
+}
+
+// WithMetadata sets a metadata value and returns the error so calls can
+// be chained.
+func (e *Error) WithMetadata(key, value string) *Error {
+	if e.Metadata == nil {
+		e.Metadata = map[string]string{}
+	}
+	e.Metadata[key] = value
+	return e
+}
+
+// FilterMetadata returns a copy of the error whose metadata only holds
+// the allowed keys.
+func (e *Error) FilterMetadata(allowed ...string) *Error {
+	c := e.clone()
+	c.Metadata = nil
+	for _, key := range allowed {
+		if value, ok := e.Metadata[key]; ok {
+			c.WithMetadata(key, value)
+		}
+	}
+	return c
+}
+
+// InheritMetadata copies the metadata of from into the error, keeping
+// the values of keys the error already has.
+func (e *Error) InheritMetadata(from *Error) *Error {
+	for key, value := range from.Metadata {
+		if _, ok := e.Metadata[key]; !ok {
+			e.WithMetadata(key, value)
+		}
+	}
+	return e
+}
+
+// AddFieldError records a validation message for field and returns the
+// error so calls can be chained.
+func (e *Error) AddFieldError(field, msg string) *Error {
+	if e.FieldErrors == nil {
+		e.FieldErrors = map[string]string{}
+	}
+	e.FieldErrors[field] = msg
+	return e
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler so an Error can be
+// stored directly in a cache such as redis. Unlike the JSON encoding it
+// keeps the retry delay in nanoseconds and includes the stack, so all
+// fields round-trip exactly.
+func (e *Error) MarshalBinary() ([]byte, error) {
+	type alias Error
+	return json.Marshal(struct {
+		*alias
+		Stack string `json:"stack,omitempty"`
+	}{(*alias)(e), e.Stack})
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+func (e *Error) UnmarshalBinary(data []byte) error {
+	type alias Error
+	v := struct {
+		*alias
+		Stack string `json:"stack"`
+	}{alias: (*alias)(e)}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	e.Stack = v.Stack
+	return nil
+}
+
+var (
+	defaultIDsMu sync.RWMutex
+	defaultIDs   = map[int32]string{}
+)
+
+// SetDefaultIDForCode registers the id used by the constructors when
+// they are given an empty id for code.
+func SetDefaultIDForCode(code int32, id string) {
+	defaultIDsMu.Lock()
+	defaultIDs[code] = id
+	defaultIDsMu.Unlock()
+}
+
+var (
+	categoriesMu sync.RWMutex
+	categories   = map[string]string{}
+)
+
+// SetCategoryForPrefix sets the category given by the constructors to
+// errors whose id starts with prefix followed by a colon.
+func SetCategoryForPrefix(prefix, category string) {
+	categoriesMu.Lock()
+	categories[prefix] = category
+	categoriesMu.Unlock()
+}
+
+var (
+	sourceMu sync.RWMutex
+	source   string
+)
+
+// SetSource sets the service name stamped on errors by the constructors.
+func SetSource(name string) {
+	sourceMu.Lock()
+	source = name
+	sourceMu.Unlock()
+}
+
+var (
+	statusTextsMu sync.RWMutex
+	statusTexts   = map[int32]string{}
+)
+
+// RegisterStatusText sets the status text used by the constructors for
+// code, taking precedence over http.StatusText.
+func RegisterStatusText(code int32, text string) {
+	statusTextsMu.Lock()
+	statusTexts[code] = text
+	statusTextsMu.Unlock()
+}
+
+// statusText returns the registered status text for code, falling back
+// to http.StatusText.
+func statusText(code int32) string {
+	statusTextsMu.RLock()
+	text, ok := statusTexts[code]
+	statusTextsMu.RUnlock()
+	if ok {
+		return text
+	}
+	return http.StatusText(int(code))
+}
+
+var (
+	hooksMu sync.RWMutex
+	hooks   []hook
+	hookSeq uint64
+)
+
+// hook is a callback registered with OnError.
+type hook struct {
+	id uint64
+	fn func(*Error)
+}
+
+// OnError registers fn to be called with every Error built by New and
+// the typed constructors. Callbacks are called in registration order.
+// The returned function unregisters fn.
+func OnError(fn func(*Error)) func() {
+	hooksMu.Lock()
+	hookSeq++
+	id := hookSeq
+	hooks = append(hooks, hook{id, fn})
+	hooksMu.Unlock()
+	return func() {
+		hooksMu.Lock()
+		defer hooksMu.Unlock()
+		kept := make([]hook, 0, len(hooks))
+		for _, h := range hooks {
+			if h.id != id {
+				kept = append(kept, h)
+			}
+		}
+		hooks = kept
+	}
+}
+
+// newError builds an Error, substituting the default id registered
+// for code when id is empty, setting the category registered for the
+// id prefix and the source, and passes it to the OnError callbacks.
+func newError(id, detail string, code int32) *Error {
+	if id == "" {
+		defaultIDsMu.RLock()
+		id = defaultIDs[code]
+		defaultIDsMu.RUnlock()
+	}
+	e := &Error{
 		Id:     id,
 		Code:   code,
 		Detail: detail,
-		Status: http.StatusText(int(code)),
+		Status: statusText(code),
+	}
+	if i := strings.Index(id, ":"); i >= 0 {
+		categoriesMu.RLock()
+		e.Category = categories[id[:i]]
+		categoriesMu.RUnlock()
+	}
+	sourceMu.RLock()
+	e.Source = source
+	sourceMu.RUnlock()
+	if CaptureStack {
+		e.Stack = stack(2 + StackSkip)
+	}
+	hooksMu.RLock()
+	hs := hooks
+	hooksMu.RUnlock()
+	for _, h := range hs {
+		h.fn(e)
+	}
+	return e
+}
+
+var (
+	publicDetailMu sync.RWMutex
+	publicDetail   = map[int32]bool{}
+)
+
+// SetPublicDetail sets whether Public keeps the detail of errors with
+// code. By default details are kept for codes below 500.
+func SetPublicDetail(code int32, keep bool) {
+	publicDetailMu.Lock()
+	publicDetail[code] = keep
+	publicDetailMu.Unlock()
+}
+
+// Public returns a copy of the error that is safe to send to external
+// clients. The developer detail, metadata and stack are removed and the
+// detail is replaced with a generic message unless the code is
+// configured to keep it.
+func (e *Error) Public() *Error {
+	p := e.clone()
+	p.DeveloperDetail = ""
+	p.Metadata = nil
+	p.Stack = ""
+	publicDetailMu.RLock()
+	keep, ok := publicDetail[e.Code]
+	publicDetailMu.RUnlock()
+	if !ok {
+		keep = e.Code < 500
+	}
+	if !keep {
+		p.Detail = ""
+		p.Detail = p.EffectiveDetail()
+	}
+	return p
+}
+
+var (
+	formatterMu sync.RWMutex
+	formatter   = fmt.Sprintf
+)
+
+// SetFormatter sets the function used by the constructors to format
+// details. A nil fn restores fmt.Sprintf.
+func SetFormatter(fn func(format string, a ...interface{}) string) {
+	if fn == nil {
+		fn = fmt.Sprintf
+	}
+	formatterMu.Lock()
+	formatter = fn
+	formatterMu.Unlock()
+}
+
+// sprintf formats with the configured formatter, checking the argument
+// count when StrictFormatting is enabled.
+func sprintf(format string, a ...interface{}) string {
+	if StrictFormatting {
+		if n := countVerbs(format); n != len(a) {
+			panic(fmt.Sprintf("errors: format %q has %d verbs but %d arguments", format, n, len(a)))
+		}
+	}
+	formatterMu.RLock()
+	fn := formatter
+	formatterMu.RUnlock()
+	return fn(format, a...)
+}
+
+// countVerbs returns the number of arguments used by format. Explicit
+// argument indexes such as %[2]d are followed the way fmt does, so the
+// result is the highest argument referenced.
+func countVerbs(format string) int {
+	n, arg := 0, 0
+	use := func() {
+		arg++
+		if arg > n {
+			n = arg
+		}
+	}
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			continue
+		}
+		for i++; i < len(format); i++ {
+			c := format[i]
+			if c == '[' {
+				if j := strings.IndexByte(format[i:], ']'); j > 0 {
+					if k, err := strconv.Atoi(format[i+1 : i+j]); err == nil {
+						arg = k - 1
+					}
+					i += j
+				}
+				continue
+			}
+			if c == '*' {
+				use()
+				continue
+			}
+			if strings.IndexByte("+-# 0123456789.", c) >= 0 {
+				continue
+			}
+			if c != '%' {
+				use()
+			}
+			break
+		}
+	}
+	return n
+}
+
+// Safe passes the error to logger and returns e.Public(), so the full
+// error is logged while only the public copy is sent to clients.
+func (e *Error) Safe(logger func(*Error)) *Error {
+	if logger != nil {
+		logger(e)
+	}
+	return e.Public()
+}
+
+// stack formats the stack of the calling goroutine, leaving out the
+// first skip frames starting with the caller of stack.
+func stack(skip int) string {
+	pc := make([]uintptr, 32)
+	n := runtime.Callers(skip+2, pc)
+	frames := runtime.CallersFrames(pc[:n])
+	var b strings.Builder
+	for {
+		f, more := frames.Next()
+		fmt.Fprintf(&b, "%s\n\t%s:%d\n", f.Function, f.File, f.Line)
+		if !more {
+			break
+		}
+	}
+	return b.String()
+}
+
+var (
+	viewsMu sync.RWMutex
+	views   = map[string][]string{}
+)
+
+// RegisterView registers a view named name that includes only the given
+// fields, named as in the JSON encoding (e.g. "id", "detail", "stack").
+func RegisterView(name string, include ...string) {
+	viewsMu.Lock()
+	views[name] = include
+	viewsMu.Unlock()
+}
+
+// ForView returns a copy of the error with only the fields included in
+// the registered view. Unknown views return a full copy.
+func (e *Error) ForView(view string) *Error {
+	viewsMu.RLock()
+	include, ok := views[view]
+	viewsMu.RUnlock()
+	if !ok {
+		return e.clone()
+	}
+	v := &Error{causes: e.causes}
+	for _, field := range include {
+		switch field {
+		case "id":
+			v.Id = e.Id
+		case "code":
+			v.Code = e.Code
+		case "detail":
+			v.Detail = e.Detail
+		case "status":
+			v.Status = e.Status
+		case "developer_detail":
+			v.DeveloperDetail = e.DeveloperDetail
+		case "category":
+			v.Category = e.Category
+		case "source":
+			v.Source = e.Source
+		case "path":
+			v.Path = e.Path
+		case "metadata":
+			v.Metadata = e.clone().Metadata
+		case "field_errors":
+			v.FieldErrors = e.clone().FieldErrors
+		case "retry_after":
+			v.RetryAfter = e.RetryAfter
+		case "stack":
+			v.Stack = e.Stack
+		}
 	}
+	return v
+}
+
+// New generates a custom error.
+func New(id, detail string, code int32) error {
+	return newError(id, detail, code)
+}
+
+// Newf generates an error for code using the id registered with
+// SetDefaultIDForCode. Unregistered codes get an empty id.
+func Newf(code int32, format string, a ...interface{}) error {
+	return newError("", sprintf(format, a...), code)
 }
 
 // Parse tries to parse a JSON string into an error. If that
@@ -45,122 +702,492 @@ func Parse(err string) *Error {
 	return e
 }
 
+// ParseMany parses a JSON object or an array of objects into a slice
+// of errors. A single object yields a one element slice. Arrays with
+// null entries are rejected.
+func ParseMany(body string) ([]*Error, error) {
+	if strings.HasPrefix(strings.TrimSpace(body), "[") {
+		var es []*Error
+		if err := json.Unmarshal([]byte(body), &es); err != nil {
+			return nil, err
+		}
+		for i, e := range es {
+			if e == nil {
+				return nil, fmt.Errorf("errors: null error at index %d", i)
+			}
+		}
+		return es, nil
+	}
+	e := new(Error)
+	if err := json.Unmarshal([]byte(body), e); err != nil {
+		return nil, err
+	}
+	return []*Error{e}, nil
+}
+
 // BadRequest generates a 400 error.
 func BadRequest(id, format string, a ...interface{}) error {
-	return &Error{
-		Id:     id,
-		Code:   400,
-		Detail: fmt.Sprintf(format, a...),
-		Status: http.StatusText(400),
+	return newError(id, sprintf(format, a...), 400)
+}
+
+// ValidationError generates a 400 error carrying fieldErrors, with a
+// detail summarizing how many fields failed.
+func ValidationError(id string, fieldErrors map[string]string) error {
+	noun := "fields"
+	if len(fieldErrors) == 1 {
+		noun = "field"
+	}
+	e := newError(id, sprintf("validation failed for %d %s", len(fieldErrors), noun), 400)
+	for field, msg := range fieldErrors {
+		e.AddFieldError(field, msg)
 	}
+	return e
 }
 
 // Unauthorized generates a 401 error.
 func Unauthorized(id, format string, a ...interface{}) error {
-	return &Error{
-		Id:     id,
-		Code:   401,
-		Detail: fmt.Sprintf(format, a...),
-		Status: http.StatusText(401),
-	}
+	return newError(id, sprintf(format, a...), 401)
 }
 
 // Forbidden generates a 403 error.
 func Forbidden(id, format string, a ...interface{}) error {
-	return &Error{
-		Id:     id,
-		Code:   403,
-		Detail: fmt.Sprintf(format, a...),
-		Status: http.StatusText(403),
-	}
+	return newError(id, sprintf(format, a...), 403)
 }
 
 // NotFound generates a 404 error.
 func NotFound(id, format string, a ...interface{}) error {
-	return &Error{
-		Id:     id,
-		Code:   404,
-		Detail: fmt.Sprintf(format, a...),
-		Status: http.StatusText(404),
-	}
+	return newError(id, sprintf(format, a...), 404)
+}
+
+// ResourceNotFound generates a 404 error with the id "{kind}:notFound".
+func ResourceNotFound(kind, id string) error {
+	return newError(kind+":notFound", sprintf("%s with id %s not found", kind, id), 404)
+}
+
+// NotFoundForPath generates a 404 error with the id "path:notFound"
+// for the request path p.
+func NotFoundForPath(p string) error {
+	return newError("path:notFound", sprintf("path %s not found", p), 404).WithPath(p)
 }
 
 // MethodNotAllowed generates a 405 error.
 func MethodNotAllowed(id, format string, a ...interface{}) error {
-	return &Error{
-		Id:     id,
-		Code:   405,
-		Detail: fmt.Sprintf(format, a...),
-		Status: http.StatusText(405),
-	}
+	return newError(id, sprintf(format, a...), 405)
+}
+
+// NotAcceptable generates a 406 error.
+func NotAcceptable(id, format string, a ...interface{}) error {
+	return newError(id, sprintf(format, a...), 406)
 }
 
 // Timeout generates a 408 error.
 func Timeout(id, format string, a ...interface{}) error {
-	return &Error{
-		Id:     id,
-		Code:   408,
-		Detail: fmt.Sprintf(format, a...),
-		Status: http.StatusText(408),
-	}
+	return newError(id, sprintf(format, a...), 408)
 }
 
 // Conflict generates a 409 error.
 func Conflict(id, format string, a ...interface{}) error {
-	return &Error{
-		Id:     id,
-		Code:   409,
-		Detail: fmt.Sprintf(format, a...),
-		Status: http.StatusText(409),
-	}
+	return newError(id, sprintf(format, a...), 409)
+}
+
+// Gone generates a 410 error.
+func Gone(id, format string, a ...interface{}) error {
+	return newError(id, sprintf(format, a...), 410)
+}
+
+// PreconditionFailed generates a 412 error.
+func PreconditionFailed(id, format string, a ...interface{}) error {
+	return newError(id, sprintf(format, a...), 412)
+}
+
+// PayloadTooLarge generates a 413 error.
+func PayloadTooLarge(id, format string, a ...interface{}) error {
+	return newError(id, sprintf(format, a...), 413)
+}
+
+// UnsupportedMediaType generates a 415 error.
+func UnsupportedMediaType(id, format string, a ...interface{}) error {
+	return newError(id, sprintf(format, a...), 415)
+}
+
+// UnprocessableEntity generates a 422 error.
+func UnprocessableEntity(id, format string, a ...interface{}) error {
+	return newError(id, sprintf(format, a...), 422)
 }
 
 // InternalServerError generates a 500 error.
 func InternalServerError(id, format string, a ...interface{}) error {
-	return &Error{
-		Id:     id,
-		Code:   500,
-		Detail: fmt.Sprintf(format, a...),
-		Status: http.StatusText(500),
-	}
+	return newError(id, sprintf(format, a...), 500)
+}
+
+// NotImplemented generates a 501 error.
+func NotImplemented(id, format string, a ...interface{}) error {
+	return newError(id, sprintf(format, a...), 501)
+}
+
+// BadGateway generates a 502 error.
+func BadGateway(id, format string, a ...interface{}) error {
+	return newError(id, sprintf(format, a...), 502)
 }
 
 // Created generates a 20x response code.
 func Created(id, format string, a ...interface{}) error {
-	return &Error{
-		Id:     id,
-		Code:   201,
-		Detail: fmt.Sprintf(format, a...),
-		Status: http.StatusText(201),
-	}
+	return newError(id, sprintf(format, a...), 201)
 }
 
 // Accepted generates a 20x response code.
 func Accepted(id, format string, a ...interface{}) error {
-	return &Error{
-		Id:     id,
-		Code:   202,
-		Detail: fmt.Sprintf(format, a...),
-		Status: http.StatusText(202),
+	return newError(id, sprintf(format, a...), 202)
+}
+
+// Redirect generates a 30x response code with the location stored in
+// Metadata["location"]. It panics if code is not a 3xx code.
+func Redirect(code int32, location string) error {
+	if code < 300 || code > 399 {
+		panic(fmt.Sprintf("errors: redirect code %d is not a 3xx code", code))
 	}
+	return newError("", "", code).WithMetadata("location", location)
 }
 
 // NoContent generates a 20x response code.
 func NoContent(id, format string, a ...interface{}) error {
-	return &Error{
-		Id:     id,
-		Code:   204,
-		Detail: "",
-		Status: http.StatusText(204),
-	}
+	return newError(id, "", 204)
 }
 
 // Found generates a 30x response code.
 func Found(id, format string, a ...interface{}) error {
-	return &Error{
-		Id:     id,
-		Code:   302,
-		Detail: "",
-		Status: http.StatusText(302),
+	return newError(id, "", 302)
+}
+
+// WithError returns a copy of ctx carrying err.
+func WithError(ctx context.Context, err error) context.Context {
+	return context.WithValue(ctx, errorKey{}, err)
+}
+
+// ErrorFromContext returns the error stored in ctx by WithError if it
+// is an *Error.
+func ErrorFromContext(ctx context.Context) (*Error, bool) {
+	e, ok := ctx.Value(errorKey{}).(*Error)
+	return e, ok
+}
+
+// Annotate prepends a formatted annotation to the detail of err. If the
+// chain of err holds an *Error its id, code, status and metadata are
+// kept, otherwise err is wrapped in a 500 error.
+func Annotate(err error, format string, a ...interface{}) error {
+	if err == nil {
+		return nil
+	}
+	msg := sprintf(format, a...)
+	if e, ok := As(err); ok {
+		ae := e.clone()
+		ae.Detail = msg + ": " + e.Detail
+		return ae
+	}
+	e := newError("", msg+": "+sprintf("%s", err.Error()), 500)
+	e.causes = []error{err}
+	return e
+}
+
+// DetailEquals reports whether err is an *Error with detail s or any
+// other error whose message is s.
+func DetailEquals(err error, s string) bool {
+	if err == nil {
+		return false
+	}
+	if e, ok := err.(*Error); ok {
+		return e.Detail == s
+	}
+	return err.Error() == s
+}
+
+// As returns the first *Error in the chain of err.
+func As(err error) (*Error, bool) {
+	var e *Error
+	if stderrors.As(err, &e) {
+		return e, true
+	}
+	return nil, false
+}
+
+// Join generates a 500 error wrapping errs, with a detail listing their
+// messages and the metadata of the wrapped *Error values. Nil errors
+// are discarded and Join returns nil if all errs are nil.
+func Join(errs ...error) error {
+	var causes []error
+	var msgs []string
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		causes = append(causes, err)
+		if e, ok := err.(*Error); ok {
+			msgs = append(msgs, e.Detail)
+		} else {
+			msgs = append(msgs, sprintf("%s", err.Error()))
+		}
+	}
+	if len(causes) == 0 {
+		return nil
+	}
+	e := newError("", strings.Join(msgs, "; "), 500)
+	e.causes = causes
+	for _, cause := range causes {
+		if ce, ok := cause.(*Error); ok {
+			e.InheritMetadata(ce)
+		}
+	}
+	return e
+}
+
+// FromRecover converts a value returned by recover into an error. An
+// *Error is returned as is, anything else becomes a 500 error.
+func FromRecover(r interface{}) *Error {
+	switch v := r.(type) {
+	case nil:
+		return nil
+	case *Error:
+		return v
+	case error:
+		return newError("", sprintf("%s", v.Error()), 500)
+	default:
+		return newError("", sprintf("%v", v), 500)
+	}
+}
+
+// Retry calls fn up to attempts times, sleeping backoff between calls,
+// until it returns nil. fn is always called at least once, even when
+// attempts is zero or negative. It returns the last error on failure.
+// If that is an *Error, a copy with the number of calls made in
+// Metadata["attempts"] is returned.
+func Retry(attempts int, backoff time.Duration, fn func() error) error {
+	return RetryContext(context.Background(), attempts, backoff, fn)
+}
+
+// RetryContext is like Retry but stops retrying once ctx is done,
+// returning the last error of fn in the same way.
+func RetryContext(ctx context.Context, attempts int, backoff time.Duration, fn func() error) error {
+	var err error
+	i := 0
+loop:
+	for ; i < attempts || i == 0; i++ {
+		if i > 0 {
+			t := time.NewTimer(backoff)
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				break loop
+			case <-t.C:
+			}
+		}
+		if err = fn(); err == nil {
+			return nil
+		}
+	}
+	if e, ok := err.(*Error); ok {
+		return e.clone().WithMetadata("attempts", strconv.Itoa(i))
+	}
+	return err
+}
+
+// FindByCode returns the first *Error with code in the chain of err, or
+// nil if there is none.
+func FindByCode(err error, code int32) *Error {
+	for err != nil {
+		if e, ok := err.(*Error); ok && e.Code == code {
+			return e
+		}
+		switch u := err.(type) {
+		case interface{ Unwrap() []error }:
+			for _, cause := range u.Unwrap() {
+				if e := FindByCode(cause, code); e != nil {
+					return e
+				}
+			}
+			return nil
+		case interface{ Unwrap() error }:
+			err = u.Unwrap()
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// FromContextErr converts a context error into an error. A deadline
+// exceeded becomes a 408 and a cancellation becomes a 499 (client closed
+// request). Other errors become a 500.
+func FromContextErr(err error) *Error {
+	switch {
+	case err == nil:
+		return nil
+	case stderrors.Is(err, context.DeadlineExceeded):
+		return newError("", sprintf("%s", err.Error()), 408)
+	case stderrors.Is(err, context.Canceled):
+		e := newError("", sprintf("%s", err.Error()), 499)
+		if e.Status == "" {
+			e.Status = "Client Closed Request"
+		}
+		return e
+	default:
+		return newError("", sprintf("%s", err.Error()), 500)
+	}
+}
+
+// RetryAfterOf returns the retry delay of the first *Error in the chain
+// of err, if one is set.
+func RetryAfterOf(err error) (time.Duration, bool) {
+	e, ok := As(err)
+	if !ok || e.RetryAfter <= 0 {
+		return 0, false
+	}
+	return e.RetryAfter, true
+}
+
+// ValidateErrorJSON checks that body is a JSON encoded error with all of
+// id, code, detail and status present and a valid HTTP status code.
+func ValidateErrorJSON(body []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return fmt.Errorf("errors: invalid error JSON: %v", err)
+	}
+	for _, name := range []string{"id", "code", "detail", "status"} {
+		if _, ok := fields[name]; !ok {
+			return fmt.Errorf("errors: invalid error JSON: missing %q", name)
+		}
+	}
+	e := new(Error)
+	if err := json.Unmarshal(body, e); err != nil {
+		return fmt.Errorf("errors: invalid error JSON: %v", err)
+	}
+	if e.Code < 100 || e.Code > 599 {
+		return fmt.Errorf("errors: invalid error JSON: code %d is not a valid HTTP status", e.Code)
+	}
+	return nil
+}
+
+var (
+	countersOnce sync.Once
+	countsMu     sync.Mutex
+	counts       = map[string]int64{}
+)
+
+// EnableCounters starts counting constructed errors by id. The counts
+// are available from Counts.
+func EnableCounters() {
+	countersOnce.Do(func() {
+		OnError(func(e *Error) {
+			countsMu.Lock()
+			counts[e.Id]++
+			countsMu.Unlock()
+		})
+	})
+}
+
+// Counts returns a copy of the number of errors constructed per id
+// since EnableCounters was called.
+func Counts() map[string]int64 {
+	countsMu.Lock()
+	defer countsMu.Unlock()
+	c := make(map[string]int64, len(counts))
+	for id, n := range counts {
+		c[id] = n
+	}
+	return c
+}
+
+// ResetCounts clears the error counts.
+func ResetCounts() {
+	countsMu.Lock()
+	counts = map[string]int64{}
+	countsMu.Unlock()
+}
+
+// IsTransient reports whether err contains an *Error that is transient.
+func IsTransient(err error) bool {
+	e, ok := As(err)
+	return ok && e.IsTransient()
+}
+
+// FromFailedResponse builds an error from the status of resp, keeping at
+// most maxBody bytes of its body in Metadata["response_body"]. The body
+// is closed.
+func FromFailedResponse(resp *http.Response, maxBody int) *Error {
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, int64(maxBody)))
+	e := newError("", sprintf("unexpected response %s", resp.Status), int32(resp.StatusCode))
+	if len(body) > 0 {
+		e.WithMetadata("response_body", string(body))
+	}
+	return e
+}
+
+// Here records the file and line of its caller in Metadata["origin"] of
+// a copy of the first *Error in the chain of err. Errors without one are
+// wrapped in a 500 error.
+func Here(err error) error {
+	if err == nil {
+		return nil
+	}
+	e, ok := As(err)
+	if ok {
+		e = e.clone()
+	} else {
+		e = newError("", sprintf("%s", err.Error()), 500)
+		e.causes = []error{err}
+	}
+	if _, file, line, ok := runtime.Caller(1); ok {
+		e.WithMetadata("origin", fmt.Sprintf("%s:%d", file, line))
+	}
+	return e
+}
+
+// FromHTTPResponseFull builds an error from an error response. The body
+// is parsed with Parse, with the code and status of resp used when the
+// body has none, and the listed headers are copied into Metadata under
+// their given names. For 429 and 503 responses the Retry-After header
+// sets RetryAfter. The body is closed.
+func FromHTTPResponseFull(resp *http.Response, headers ...string) *Error {
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	e := Parse(string(body))
+	if e.Code == 0 {
+		e.Code = int32(resp.StatusCode)
+	}
+	if e.Status == "" {
+		e.Status = statusText(e.Code)
+	}
+	for _, name := range headers {
+		if value := resp.Header.Get(name); value != "" {
+			e.WithMetadata(name, value)
+		}
+	}
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		if d, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+			e.RetryAfter = d
+		}
+	}
+	return e
+}
+
+// parseRetryAfter parses a Retry-After header given either in seconds
+// or as an HTTP date.
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	t, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	if d := time.Until(t); d > 0 {
+		return d, true
 	}
+	return 0, true
 }